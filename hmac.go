@@ -0,0 +1,63 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadHMACKey reads the shared secret used to verify server-signed secret payloads.  An empty
+// path means verification is disabled, which is the default so existing deployments aren't
+// broken by upgrading.
+func loadHMACKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SecretHMACKeyFile '%s': %v", path, err)
+	}
+	return key, nil
+}
+
+// computeSecretSignature is the HMAC the server is expected to have produced for secret: an
+// HMAC-SHA256 over the secret's name, content, and expiry, in that order.
+func computeSecretSignature(key []byte, name string, content []byte, expiry int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	mac.Write(content)
+	var expiryBytes [8]byte
+	binary.BigEndian.PutUint64(expiryBytes[:], uint64(expiry))
+	mac.Write(expiryBytes[:])
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySecretSignature checks secret.Signature against what we'd compute ourselves.  If key is
+// empty, HMAC verification is disabled (no SecretHMACKeyFile configured) and every secret passes.
+func verifySecretSignature(key []byte, secret Secret) bool {
+	if len(key) == 0 {
+		return true
+	}
+	if secret.Signature == "" {
+		return false
+	}
+	expected := computeSecretSignature(key, secret.Name, secret.Content, secret.Expiry)
+	return hmac.Equal([]byte(expected), []byte(secret.Signature))
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build kubesink
+
+package keysync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func init() {
+	sinkBuilders["kube"] = newKubeSecretSink
+}
+
+// KubeSecretSink upserts one Kubernetes Secret object per client (named after ClientConfig.DirName)
+// in a configured namespace, keyed off the in-cluster API, so keysync can run in a pod without
+// writing anywhere on the host filesystem.
+type KubeSecretSink struct {
+	// mu serializes Write/Delete's read-modify-write against the Kubernetes Secret, since Sync
+	// calls them concurrently (one per in-flight secret) via copiersPerClient.
+	mu        sync.Mutex
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	logger    *logrus.Entry
+}
+
+func newKubeSecretSink(clientConfig ClientConfig, config *Config, logger *logrus.Entry) (SecretSink, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("building in-cluster config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("building Kubernetes client: %v", err)
+	}
+	return &KubeSecretSink{
+		client:    clientset,
+		namespace: config.KubeNamespace,
+		name:      clientConfig.DirName,
+		logger:    logger,
+	}, nil
+}
+
+func (k *KubeSecretSink) secrets() (*v1.Secret, error) {
+	return k.client.CoreV1().Secrets(k.namespace).Get(k.name, metav1.GetOptions{})
+}
+
+// Write implements SecretSink by upserting secret.Name into this client's Kubernetes Secret.
+func (k *KubeSecretSink) Write(secret Secret) (*FileInfo, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	existing, err := k.secrets()
+	if errors.IsNotFound(err) {
+		existing = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: k.name, Namespace: k.namespace},
+			Data:       map[string][]byte{},
+		}
+		if _, err := k.client.CoreV1().Secrets(k.namespace).Create(existing); err != nil {
+			return nil, fmt.Errorf("creating Secret '%s': %v", k.name, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("fetching Secret '%s': %v", k.name, err)
+	}
+	if existing.Data == nil {
+		// A pre-existing Secret (operator-provisioned, or simply created empty) deserializes
+		// with a nil Data map rather than an empty one.
+		existing.Data = map[string][]byte{}
+	}
+
+	existing.Data[secret.Name] = secret.Content
+	if _, err := k.client.CoreV1().Secrets(k.namespace).Update(existing); err != nil {
+		return nil, fmt.Errorf("updating Secret '%s': %v", k.name, err)
+	}
+	return &FileInfo{}, nil
+}
+
+// Delete implements SecretSink by removing name's key from this client's Kubernetes Secret.
+func (k *KubeSecretSink) Delete(name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	existing, err := k.secrets()
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetching Secret '%s': %v", k.name, err)
+	}
+	delete(existing.Data, name)
+	_, err = k.client.CoreV1().Secrets(k.namespace).Update(existing)
+	return err
+}
+
+// Validate implements SecretSink by comparing the stored key's content hash against what we
+// recorded when we last wrote it; Kubernetes Secrets don't carry our FileInfo permission bits.
+func (k *KubeSecretSink) Validate(secret Secret, state secretState) bool {
+	if state.Checksum != secret.Checksum {
+		return false
+	}
+	existing, err := k.secrets()
+	if err != nil {
+		return false
+	}
+	content, ok := existing.Data[secret.Name]
+	if !ok {
+		return false
+	}
+	return state.ContentHash == sha256.Sum256(content)
+}
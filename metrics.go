@@ -0,0 +1,33 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+// incCounter bumps a named counter on entry's metricsHandle, if one was configured. Centralized
+// here (rather than inlined at each call site) so every caller gets the same nil-safety without
+// repeating the check.
+func (entry *syncerEntry) incCounter(name string) {
+	if entry.metricsHandle == nil {
+		return
+	}
+	entry.metricsHandle.GetCounter(name).Inc(1)
+}
+
+// updateGauge sets a named gauge on s.metricsHandle, if one was configured.
+func (s *Syncer) updateGauge(name string, value int64) {
+	if s.metricsHandle == nil {
+		return
+	}
+	s.metricsHandle.GetGauge(name).Update(value)
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// defaultWorkers picks a sane default pool size for the platform we're running on.  Interactive
+// OSes (laptops/desktops) default low so keysync doesn't compete with the foreground user, while
+// Linux servers default higher since they're usually dedicated and have more secrets to pull.
+func defaultWorkers() int {
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		return 2
+	default:
+		return 8
+	}
+}
+
+// pullState is the lifecycle of a single in-flight secret fetch.
+type pullState int
+
+const (
+	pullPending pullState = iota
+	pullFetching
+	pullWritten
+	pullErrored
+)
+
+func (p pullState) String() string {
+	switch p {
+	case pullPending:
+		return "pending"
+	case pullFetching:
+		return "fetching"
+	case pullWritten:
+		return "written"
+	case pullErrored:
+		return "errored"
+	default:
+		return "unknown"
+	}
+}
+
+// secretPullerState tracks the progress of pulling a single secret for a single client, so that
+// concurrent workers can report status without racing on the syncerEntry itself.
+type secretPullerState struct {
+	mu        sync.Mutex
+	client    string
+	name      string
+	state     pullState
+	bytes     int64
+	startTime time.Time
+	lastError error
+}
+
+func newSecretPullerState(client, name string) *secretPullerState {
+	return &secretPullerState{client: client, name: name, state: pullPending, startTime: time.Now()}
+}
+
+func (p *secretPullerState) setFetching() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = pullFetching
+}
+
+func (p *secretPullerState) setWritten(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = pullWritten
+	p.bytes = n
+}
+
+func (p *secretPullerState) setErrored(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = pullErrored
+	p.lastError = err
+}
+
+// SecretProgress is a point-in-time snapshot of a secretPullerState, safe to hand out to callers
+// outside the package (metrics handlers, debug endpoints) without further locking.
+type SecretProgress struct {
+	Client    string
+	Name      string
+	State     string
+	Bytes     int64
+	StartTime time.Time
+	LastError error
+}
+
+func (p *secretPullerState) snapshot() SecretProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return SecretProgress{
+		Client:    p.client,
+		Name:      p.name,
+		State:     p.state.String(),
+		Bytes:     p.bytes,
+		StartTime: p.startTime,
+		LastError: p.lastError,
+	}
+}
+
+// InFlight returns a snapshot of every secret pull currently tracked across all clients,
+// including ones that have already finished this pass.  Intended for operators to spot stuck or
+// slow fetches (e.g. via a debug handler wired up to metricsHandle).
+func (s *Syncer) InFlight() []SecretProgress {
+	s.inFlightMutex.Lock()
+	defer s.inFlightMutex.Unlock()
+	progress := make([]SecretProgress, 0, len(s.inFlight))
+	for _, state := range s.inFlight {
+		progress = append(progress, state.snapshot())
+	}
+	return progress
+}
+
+func (s *Syncer) recordInFlight(state *secretPullerState) {
+	s.inFlightMutex.Lock()
+	if s.inFlight == nil {
+		s.inFlight = map[string]*secretPullerState{}
+	}
+	s.inFlight[state.client+"/"+state.name] = state
+	inFlightCount := int64(len(s.inFlight))
+	s.inFlightMutex.Unlock()
+	// Surface the number of tracked pulls so operators can see stuck or slow fetches without
+	// having to wire up a debug handler around InFlight themselves.
+	s.updateGauge("keysync.secrets_in_flight", inFlightCount)
+}
+
+// copiersPerClient runs fn for each name in names using a bounded worker pool, waiting for all
+// of them to finish before returning.  It's named after Syncthing's copiersPerFolder pool: a
+// small number of workers per client, rather than one goroutine per secret or per client.
+func copiersPerClient(names []string, workers int, fn func(name string)) {
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				fn(name)
+			}
+		}()
+	}
+	for _, name := range names {
+		work <- name
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how aggressively we back off from secrets that fail to fetch or write, so
+// a transiently-unreachable server doesn't get hammered every PollInterval forever.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	MaxAttempts    int
+}
+
+// defaultRetryPolicy starts at 5 seconds and doubles on each consecutive failure, capped at 10
+// minutes (plus up to 25% jitter from randomize), so a persistently-failing secret is retried
+// less and less often but never dropped.
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialBackoff: 5 * time.Second,
+		MaxBackoff:     10 * time.Minute,
+		Multiplier:     2,
+		MaxAttempts:    8,
+	}
+}
+
+// circuitBreakWindow is how long we hold off on an entire client after every one of its secrets
+// failed in a single pass, rather than hammering an unreachable server every poll.
+const circuitBreakWindow = 2 * time.Minute
+
+// secretRetryState tracks consecutive failures for a single secret within a single client.
+type secretRetryState struct {
+	consecutiveFailures int
+	nextAttempt         time.Time
+}
+
+// shouldSkip reports whether name is still within its backoff window.
+func (entry *syncerEntry) shouldSkip(name string) bool {
+	entry.retryMutex.Lock()
+	defer entry.retryMutex.Unlock()
+	state, ok := entry.retries[name]
+	if !ok {
+		return false
+	}
+	return time.Now().Before(state.nextAttempt)
+}
+
+// retryTracker accumulates per-pass success/failure tallies, used only to decide whether to trip
+// the client-wide circuit breaker once the pass is done. The long-lived backoff state lives in
+// entry.retries instead.
+type retryTracker struct {
+	policy RetryPolicy
+
+	mu        sync.Mutex
+	attempted int
+	failed    int
+}
+
+func newRetryTracker(policy RetryPolicy) *retryTracker {
+	return &retryTracker{policy: policy}
+}
+
+// recordResult updates name's backoff state on entry, and this pass's attempted/failed tallies.
+func (t *retryTracker) recordResult(entry *syncerEntry, name string, err error) {
+	t.mu.Lock()
+	t.attempted++
+	if err != nil {
+		t.failed++
+	}
+	t.mu.Unlock()
+
+	entry.retryMutex.Lock()
+	defer entry.retryMutex.Unlock()
+	if entry.retries == nil {
+		entry.retries = map[string]*secretRetryState{}
+	}
+	if err == nil {
+		delete(entry.retries, name)
+		return
+	}
+	state, ok := entry.retries[name]
+	if !ok {
+		state = &secretRetryState{}
+		entry.retries[name] = state
+	}
+	state.consecutiveFailures++
+	attempts := state.consecutiveFailures
+	if attempts > t.policy.MaxAttempts {
+		attempts = t.policy.MaxAttempts
+	}
+	backoff := time.Duration(float64(t.policy.InitialBackoff) * math.Pow(t.policy.Multiplier, float64(attempts-1)))
+	if backoff > t.policy.MaxBackoff {
+		backoff = t.policy.MaxBackoff
+	}
+	state.nextAttempt = time.Now().Add(randomize(backoff))
+}
+
+// allFailed reports whether every secret attempted this pass failed, which points at the client
+// itself being unreachable rather than any one secret being broken.
+func (t *retryTracker) allFailed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.attempted > 0 && t.failed == t.attempted
+}
+
+// circuitOpen reports whether client is within its circuit-break window, and until when.
+func (s *Syncer) circuitOpen(client string) (time.Time, bool) {
+	s.circuitMutex.Lock()
+	defer s.circuitMutex.Unlock()
+	until, ok := s.circuitUntil[client]
+	if !ok || time.Now().After(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// tripCircuit marks client as circuit-broken for circuitBreakWindow.
+func (s *Syncer) tripCircuit(client string) {
+	s.circuitMutex.Lock()
+	defer s.circuitMutex.Unlock()
+	if s.circuitUntil == nil {
+		s.circuitUntil = map[string]time.Time{}
+	}
+	s.circuitUntil[client] = time.Now().Add(circuitBreakWindow)
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// SecretSink is where a client's secrets end up. FSSink, writing to a directory on the local
+// filesystem, is the original and default behavior; KubeSecretSink and TemplateSink (both behind
+// build tags; KubeSecretSink pulls in the Kubernetes client libraries) let keysync run somewhere
+// writing to a host directory isn't an option.
+type SecretSink interface {
+	// Write commits secret to the sink, returning the FileInfo to remember for later Validate
+	// calls.
+	Write(secret Secret) (*FileInfo, error)
+	// Delete removes a previously-written secret by name.
+	Delete(name string) error
+	// Validate reports whether secret is already present in the sink exactly as state says we
+	// last wrote it, so Sync can skip re-fetching it.
+	Validate(secret Secret, state secretState) bool
+}
+
+// sinkBuilders holds the build-tagged alternative sinks (see kube_sink.go, template_sink.go),
+// keyed by the name a client picks in ClientConfig.Sink. It's empty unless those files are
+// compiled in, in which case their init() functions register themselves here.
+var sinkBuilders = map[string]func(ClientConfig, *Config, *logrus.Entry) (SecretSink, error){}
+
+// orphanRemover is implemented by sinks that accumulate stale output between runs and so need a
+// post-pass sweep. FSSink needs this because stray files can pile up in WriteDirectory. Only
+// FSSink implements it: TemplateSink renders only the secrets written to it by this process, and
+// KubeSecretSink updates keys in place, so keys already in its Secret that this process never
+// writes or deletes are left there.
+type orphanRemover interface {
+	removeOrphans(keep map[string]struct{}) error
+}
+
+// FSSink writes secrets as files in a directory, with the permissions and ownership keysync has
+// always supported. It's the sink syncerEntry uses unless a build-tagged alternative sink is
+// configured.
+type FSSink struct {
+	Config  WriteConfig
+	hmacKey []byte
+	logger  *logrus.Entry
+}
+
+// NewFSSink builds the default, filesystem-backed sink.
+func NewFSSink(config WriteConfig, hmacKey []byte, logger *logrus.Entry) *FSSink {
+	return &FSSink{Config: config, hmacKey: hmacKey, logger: logger}
+}
+
+// withDirectory returns a copy of f pointed at a different directory, used by the staging-sync
+// path to write into a sibling directory before renaming it into place.
+func (f *FSSink) withDirectory(dir string) *FSSink {
+	config := f.Config
+	config.WriteDirectory = dir
+	return &FSSink{Config: config, hmacKey: f.hmacKey, logger: f.logger}
+}
+
+// Write implements SecretSink.
+func (f *FSSink) Write(secret Secret) (*FileInfo, error) {
+	return atomicWrite(secret.Name, secret, f.Config)
+}
+
+// Delete implements SecretSink.
+func (f *FSSink) Delete(name string) error {
+	return os.Remove(filepath.Join(f.Config.WriteDirectory, name))
+}
+
+// Validate implements SecretSink, and is what IsValidOnDisk used to do directly: check the
+// secret's content, permissions, ownership, and HMAC signature all still match what we last
+// wrote.
+func (f *FSSink) Validate(secret Secret, state secretState) bool {
+	if state.Checksum != secret.Checksum {
+		return false
+	}
+	path := filepath.Join(f.Config.WriteDirectory, secret.Name)
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	fileinfo, err := GetFileInfo(file)
+	if err != nil {
+		return false
+	}
+	if state.FileInfo != *fileinfo {
+		return false
+	}
+
+	var b bytes.Buffer
+	if _, err = b.ReadFrom(file); err != nil {
+		return false
+	}
+	hash := sha256.Sum256(b.Bytes())
+	if state.ContentHash != hash {
+		// As tempting as it is, we shouldn't log hashes as they'd leak information about the secret.
+		f.logger.WithField("secret", secret.Name).Warnf("Secret modified on disk?")
+		return false
+	}
+
+	// Re-verify the signature rather than trusting the cached Checksum match above: an attacker
+	// who can tamper with both the on-disk content and our SyncState cache shouldn't be able to
+	// fool us by also leaving the (stale) checksum intact. secret is the list-only metadata
+	// object and never carries Content, so verify against what's actually on disk instead of
+	// secret itself -- otherwise this would fail HMAC verification for every secret, every pass.
+	onDisk := secret
+	onDisk.Content = b.Bytes()
+	if !verifySecretSignature(f.hmacKey, onDisk) {
+		f.logger.WithField("secret", secret.Name).Warn("Secret failed HMAC verification on disk")
+		return false
+	}
+
+	return true
+}
+
+// removeOrphans implements orphanRemover: anything in WriteDirectory that isn't in keep wasn't
+// written by this pass, so it's either stale or something else's file, and we remove it.
+func (f *FSSink) removeOrphans(keep map[string]struct{}) error {
+	fileInfos, err := ioutil.ReadDir(f.Config.WriteDirectory)
+	if err != nil {
+		return fmt.Errorf("Couldn't read directory: %s\n", f.Config.WriteDirectory)
+	}
+	for _, fileInfo := range fileInfos {
+		existingFile := fileInfo.Name()
+		if _, present := keep[existingFile]; !present {
+			f.logger.WithField("file", existingFile).Info("Removing unknown file")
+			os.Remove(filepath.Join(f.Config.WriteDirectory, existingFile))
+		}
+	}
+	return nil
+}
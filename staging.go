@@ -0,0 +1,198 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// AtomicMode selects how a batch of secrets is committed to disk: a whole new directory swapped
+// in with a single rename, or one atomic write per file.  Directory mode is preferred since it
+// guarantees a client's secrets never appear partially-updated; file mode is the fallback
+// buildClient picks when directoryRenameSupported's probe can't rename a populated directory
+// (e.g. on some network filesystems).  A WriteDirectory that can't itself be renamed, such as a
+// bind-mount point, is not detected by that probe and does not select file mode.
+type AtomicMode int
+
+const (
+	// AtomicDirectory stages a whole client's secrets in a sibling directory, then renames it
+	// into place in one step.
+	AtomicDirectory AtomicMode = iota
+	// AtomicFile writes each secret with its own atomic rename, in place, like keysync has
+	// always done.
+	AtomicFile
+)
+
+// stagingDir returns a sibling of dir that won't collide with a concurrent or prior sync.
+func stagingDir(dir string) string {
+	return fmt.Sprintf("%s.staging-%d", dir, rand.Int63())
+}
+
+// syncDirectory builds the full contents of fsSink's directory in a staging directory, fetching
+// each of toFetch via fetch, and only renames the staging directory into place once every fetch
+// has succeeded.  On any fetch failure, the staging directory is discarded and the error is
+// returned, leaving the last-known-good directory untouched.
+//
+// secrets in keep (ones Sink.Validate already said are current, and ones still within their retry
+// backoff) are hard-linked into the staging directory so the rename produces a complete,
+// consistent tree.
+func (entry *syncerEntry) syncDirectory(fsSink *FSSink, toFetch []string, keep []string, workers int, onProgress func(*secretPullerState), tracker *retryTracker) (map[string]secretState, error) {
+	baseDir := fsSink.Config.WriteDirectory
+	staging := stagingDir(baseDir)
+	if err := os.MkdirAll(staging, 0775); err != nil {
+		return nil, fmt.Errorf("creating staging directory '%s': %v", staging, err)
+	}
+	// If we bail out before the rename below, clean up the staging directory so we don't
+	// leak one every time a fetch fails.
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(staging)
+		}
+	}()
+
+	for _, name := range keep {
+		oldPath := filepath.Join(baseDir, name)
+		newPath := filepath.Join(staging, name)
+		if err := os.Link(oldPath, newPath); err != nil {
+			if os.IsNotExist(err) {
+				// A secret still in its initial backoff window (failed before it was ever
+				// written) has nothing on disk to carry over; that's fine, it just stays
+				// absent from the staged directory until a fetch finally succeeds.
+				continue
+			}
+			return nil, fmt.Errorf("carrying over unchanged secret '%s': %v", name, err)
+		}
+	}
+
+	stagingSink := fsSink.withDirectory(staging)
+
+	newState := map[string]secretState{}
+	// firstErr is written from the copiersPerClient callback below, which runs on multiple
+	// goroutines at once; errMutex guards it the same way pendingMutex guards pendingDeletions
+	// in the non-directory Sync path.
+	var errMutex sync.Mutex
+	var firstErr error
+	copiersPerClient(toFetch, workers, func(name string) {
+		progress := newSecretPullerState(entry.ClientConfig.DirName, name)
+		if onProgress != nil {
+			onProgress(progress)
+		}
+		progress.setFetching()
+
+		secret, err := entry.Client.Secret(name)
+		if err != nil {
+			if _, deleted := err.(SecretDeleted); deleted {
+				// Nothing to stage; the reconciliation pass in Sync will clean this up.
+				return
+			}
+			progress.setErrored(err)
+			tracker.recordResult(entry, name, err)
+			errMutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errMutex.Unlock()
+			return
+		}
+		if !verifySecretSignature(entry.hmacKey, secret) {
+			err := fmt.Errorf("secret '%s' failed HMAC verification", secret.Name)
+			progress.setErrored(err)
+			entry.incCounter("keysync.hmac_verification_failed")
+			tracker.recordResult(entry, name, err)
+			errMutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errMutex.Unlock()
+			return
+		}
+		fileinfo, err := stagingSink.Write(secret)
+		if err != nil {
+			progress.setErrored(err)
+			err = fmt.Errorf("staging secret '%s': %v", secret.Name, err)
+			tracker.recordResult(entry, name, err)
+			errMutex.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			errMutex.Unlock()
+			return
+		}
+		tracker.recordResult(entry, name, nil)
+		entry.stateMutex.Lock()
+		newState[secret.Name] = secretState{sha256.Sum256(secret.Content), secret.Checksum, *fileinfo}
+		entry.stateMutex.Unlock()
+		progress.setWritten(int64(len(secret.Content)))
+	})
+
+	if firstErr != nil {
+		// Partial failure: discard the staging directory (via the deferred RemoveAll above)
+		// and leave the last-known-good secrets on disk untouched.
+		return nil, firstErr
+	}
+
+	old := baseDir + fmt.Sprintf(".previous-%d", rand.Int63())
+	if err := os.Rename(baseDir, old); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("moving aside previous directory: %v", err)
+	}
+	if err := os.Rename(staging, baseDir); err != nil {
+		// Try to put the previous directory back so we don't leave the client with nothing.
+		os.Rename(old, baseDir)
+		return nil, fmt.Errorf("renaming staging directory into place: %v", err)
+	}
+	committed = true
+	os.RemoveAll(old)
+
+	for name, keptState := range entry.SyncState {
+		if _, wasKept := newState[name]; !wasKept {
+			for _, k := range keep {
+				if k == name {
+					newState[name] = keptState
+					break
+				}
+			}
+		}
+	}
+	return newState, nil
+}
+
+// directoryRenameSupported does a best-effort check for whether dir's filesystem lets us rename
+// a populated directory across itself; if not, callers should fall back to AtomicFile.  The probe
+// is a fresh directory inside dir, so it says nothing about whether an existing directory (such
+// as a mount point) can itself be renamed.
+func directoryRenameSupported(dir string) bool {
+	probe := stagingDir(filepath.Join(dir, "rename-probe"))
+	if err := os.MkdirAll(probe, 0775); err != nil {
+		return false
+	}
+	defer os.RemoveAll(probe)
+	f, err := os.Create(filepath.Join(probe, "probe"))
+	if err != nil {
+		return false
+	}
+	f.Close()
+	target := probe + ".rename-check"
+	if err := os.Rename(probe, target); err != nil {
+		return false
+	}
+	os.RemoveAll(target)
+	return true
+}
@@ -15,10 +15,8 @@
 package keysync
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net/url"
 	"os"
@@ -43,8 +41,25 @@ type secretState struct {
 type syncerEntry struct {
 	Client
 	ClientConfig
-	WriteConfig
-	SyncState map[string]secretState
+	// Sink is where this client's secrets get written.  It's an FSSink unless config selects a
+	// build-tagged alternative (KubeSecretSink, TemplateSink).
+	Sink SecretSink
+	// Atomic selects how this client's secrets are committed to disk. Only meaningful when Sink
+	// is an *FSSink. buildClient sets it to AtomicDirectory, or to AtomicFile when
+	// directoryRenameSupported reports the filesystem can't support a directory rename; it is
+	// not read from any configuration.
+	Atomic AtomicMode
+	// hmacKey is the shared secret used to verify Secret.Signature, loaded once from
+	// Config.SecretHMACKeyFile and handed to every client.  Nil disables verification.
+	hmacKey       []byte
+	metricsHandle *sqmetrics.SquareMetrics
+	SyncState     map[string]secretState
+	stateMutex    sync.Mutex
+
+	// retries tracks consecutive failures and backoff per secret name, so a persistently-failing
+	// secret doesn't get retried every pass.
+	retries    map[string]*secretRetryState
+	retryMutex sync.Mutex
 }
 
 // A Syncer manages a collection of clients, handling downloads and writing out updated secrets.
@@ -52,20 +67,41 @@ type syncerEntry struct {
 type Syncer struct {
 	config        *Config
 	server        *url.URL
-	clients       map[string]syncerEntry
+	clients       map[string]*syncerEntry
 	logger        *logrus.Entry
 	metricsHandle *sqmetrics.SquareMetrics
 	syncMutex     sync.Mutex
+
+	// Workers is the number of secrets pulled concurrently per client.  Defaults to
+	// defaultWorkers() when zero, which is conservative on interactive OSes and higher on
+	// Linux servers.
+	Workers int
+
+	inFlightMutex sync.Mutex
+	inFlight      map[string]*secretPullerState
+
+	hmacKey []byte
+
+	// RetryPolicy controls per-secret backoff. Defaults to defaultRetryPolicy().
+	RetryPolicy RetryPolicy
+
+	circuitMutex sync.Mutex
+	circuitUntil map[string]time.Time
 }
 
 // NewSyncer instantiates the main stateful object in Keysync.
 func NewSyncer(config *Config, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (*Syncer, error) {
-	syncer := Syncer{config: config, clients: map[string]syncerEntry{}, logger: logger, metricsHandle: metricsHandle}
+	syncer := Syncer{config: config, clients: map[string]*syncerEntry{}, logger: logger, metricsHandle: metricsHandle, Workers: defaultWorkers(), RetryPolicy: defaultRetryPolicy()}
 	serverUrl, err := url.Parse("https://" + config.Server)
 	if err != nil {
 		return nil, fmt.Errorf("Failed parsing server: %s", config.Server)
 	}
 	syncer.server = serverUrl
+	hmacKey, err := loadHMACKey(config.SecretHMACKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	syncer.hmacKey = hmacKey
 	return &syncer, nil
 }
 
@@ -94,7 +130,7 @@ func (s *Syncer) LoadClients() error {
 			continue
 
 		}
-		s.clients[name] = *client
+		s.clients[name] = client
 	}
 	for name, client := range s.clients {
 		// TODO: Record for cleanup. We don't want to actually do it in this function, so we record it for the
@@ -133,7 +169,42 @@ func (s *Syncer) buildClient(name string, clientConfig ClientConfig, metricsHand
 		ChownFiles:        s.config.ChownFiles,
 		DefaultOwnership:  defaultOwnership,
 	}
-	return &syncerEntry{client, clientConfig, writeConfig, map[string]secretState{}}, nil
+	atomic := AtomicDirectory
+	if !directoryRenameSupported(filepath.Dir(writeConfig.WriteDirectory)) {
+		s.logger.WithField("client", name).Warn("Directory rename unsupported on this filesystem, falling back to per-file atomic writes")
+		atomic = AtomicFile
+	}
+	sink, err := s.buildSink(clientConfig, writeConfig, clientLogger)
+	if err != nil {
+		return nil, err
+	}
+	return &syncerEntry{
+		Client:        client,
+		ClientConfig:  clientConfig,
+		Sink:          sink,
+		Atomic:        atomic,
+		hmacKey:       s.hmacKey,
+		metricsHandle: metricsHandle,
+		SyncState:     map[string]secretState{},
+		retries:       map[string]*secretRetryState{},
+	}, nil
+}
+
+// buildSink picks the SecretSink for a client.  Sink selection besides the default FSSink
+// requires a build-tagged sink (see kube_sink.go, template_sink.go) to be compiled in and
+// configured via clientConfig.Sink; with neither, every client gets an FSSink.
+func (s *Syncer) buildSink(clientConfig ClientConfig, writeConfig WriteConfig, logger *logrus.Entry) (SecretSink, error) {
+	if clientConfig.Sink == "" {
+		return NewFSSink(writeConfig, s.hmacKey, logger), nil
+	}
+	newSink, ok := sinkBuilders[clientConfig.Sink]
+	if !ok {
+		// A configured-but-unregistered sink (wrong build tag, or a typo) must not silently
+		// fall back to writing secrets straight to the host filesystem: that's exactly the
+		// behavior choosing a non-default sink exists to avoid.
+		return nil, fmt.Errorf("unknown sink '%s' for client '%s': binary built without support for it?", clientConfig.Sink, clientConfig.DirName)
+	}
+	return newSink(clientConfig, s.config, logger)
 }
 
 // Randomize the sleep interval, increasing up to 1/4 of the duration.
@@ -175,8 +246,20 @@ func (s *Syncer) RunOnce() error {
 	if err != nil {
 		return err
 	}
+	workers := s.Workers
+	if workers < 1 {
+		workers = defaultWorkers()
+	}
+	retryPolicy := s.RetryPolicy
+	if retryPolicy == (RetryPolicy{}) {
+		retryPolicy = defaultRetryPolicy()
+	}
 	for name, entry := range s.clients {
-		err = entry.Sync()
+		if until, broken := s.circuitOpen(name); broken {
+			s.logger.WithField("name", name).WithField("until", until).Warn("Client circuit-broken, skipping")
+			continue
+		}
+		err = entry.Sync(workers, s.recordInFlight, retryPolicy, func() { s.tripCircuit(name) })
 		if err != nil {
 			// Record error but continue updating other clients
 			s.logger.WithError(err).WithField("name", name).Error("Failed while syncing")
@@ -185,11 +268,12 @@ func (s *Syncer) RunOnce() error {
 	return nil
 }
 
-// Sync this: Download and write all secrets.
-func (entry *syncerEntry) Sync() error {
-	err := os.MkdirAll(entry.WriteDirectory, 0775)
-	if err != nil {
-		return fmt.Errorf("Making client directory '%s': %v", entry.WriteDirectory, err)
+// Sync this: Download and write all secrets, pulling up to workers secrets concurrently.
+func (entry *syncerEntry) Sync(workers int, onProgress func(*secretPullerState), retryPolicy RetryPolicy, onAllFailed func()) error {
+	if fsSink, ok := entry.Sink.(*FSSink); ok {
+		if err := os.MkdirAll(fsSink.Config.WriteDirectory, 0775); err != nil {
+			return fmt.Errorf("Making client directory '%s': %v", fsSink.Config.WriteDirectory, err)
+		}
 	}
 	secrets, ok := entry.Client.SecretList()
 	if !ok {
@@ -197,40 +281,107 @@ func (entry *syncerEntry) Sync() error {
 		return nil
 	}
 
-	pendingDeletions := []string{}
+	tracker := newRetryTracker(retryPolicy)
+
+	toFetch := []string{}
+	keep := []string{}
 	for name, secretMetadata := range secrets {
-		if entry.IsValidOnDisk(secretMetadata) {
-			// The secret is already downloaded, so no action needed
+		if entry.shouldSkip(name) {
+			entry.logger.WithField("secret", name).Info("Skipping secret still within retry backoff")
+			entry.incCounter("keysync.secret_retry_skipped")
+			// Still backing off isn't "gone from the server": keep whatever we last wrote so a
+			// staged sync doesn't rename a directory that's simply missing this secret into place.
+			keep = append(keep, name)
+			continue
+		}
+		if entry.Sink.Validate(secretMetadata, entry.SyncState[name]) {
+			// The secret is already present in the sink, so no action needed
 			entry.logger.WithField("secret", name).Warn("Not requesting still-valid secret")
+			keep = append(keep, name)
 			continue
 		}
+		toFetch = append(toFetch, name)
+	}
+
+	if fsSink, ok := entry.Sink.(*FSSink); ok && entry.Atomic == AtomicDirectory {
+		newState, err := entry.syncDirectory(fsSink, toFetch, keep, workers, onProgress, tracker)
+		if onAllFailed != nil && tracker.allFailed() {
+			onAllFailed()
+		}
+		if err != nil {
+			return fmt.Errorf("staged sync for '%s': %v", fsSink.Config.WriteDirectory, err)
+		}
+		entry.stateMutex.Lock()
+		entry.SyncState = newState
+		entry.stateMutex.Unlock()
+		return nil
+	}
+
+	var pendingMutex sync.Mutex
+	pendingDeletions := []string{}
+	addPendingDeletion := func(name string) {
+		pendingMutex.Lock()
+		defer pendingMutex.Unlock()
+		pendingDeletions = append(pendingDeletions, name)
+	}
+
+	copiersPerClient(toFetch, workers, func(name string) {
+		progress := newSecretPullerState(entry.ClientConfig.DirName, name)
+		if onProgress != nil {
+			onProgress(progress)
+		}
+		progress.setFetching()
+
 		secret, err := entry.Client.Secret(name)
 		if err != nil {
 			// This is essentially a race condition: A secret was deleted between listing and fetching
 			if _, deleted := err.(SecretDeleted); deleted {
 				// We defer actual deletion to the loop below, so that new secrets are always written
-				// before any are deleted.
-				pendingDeletions = append(pendingDeletions, name)
+				// before any are deleted. A deletion isn't a failure, so it doesn't feed backoff.
+				addPendingDeletion(name)
 			} else {
 				// There was some other error talking to the server.
 				// We put a value in syncState so we don't delete it as an unknown file.
+				progress.setErrored(err)
+				entry.stateMutex.Lock()
 				entry.SyncState[name] = secretState{}
+				entry.stateMutex.Unlock()
+				tracker.recordResult(entry, name, err)
 			}
-			continue
+			return
+		}
+		if !verifySecretSignature(entry.hmacKey, secret) {
+			err := fmt.Errorf("HMAC verification failed")
+			entry.logger.WithField("file", secret.Name).Error("Secret failed HMAC verification, refusing to write")
+			entry.incCounter("keysync.hmac_verification_failed")
+			progress.setErrored(err)
+			tracker.recordResult(entry, name, err)
+			return
 		}
-		fileinfo, err := atomicWrite(secret.Name, secret, entry.WriteConfig)
+		fileinfo, err := entry.Sink.Write(secret)
 		if err != nil {
 			entry.logger.WithError(err).WithField("file", secret.Name).Error("Failed while writing secret")
-			// This situation is unlikely: We couldn't write the secret to disk.
-			// If atomicWrite fails, then no changes to the secret on-disk were made, thus we make no change
-			// to the entry.SyncState
-			continue
+			// This situation is unlikely: We couldn't write the secret to the sink.
+			// If Write fails, no changes were made, thus we make no change to the entry.SyncState
+			progress.setErrored(err)
+			tracker.recordResult(entry, name, err)
+			return
 		}
+		tracker.recordResult(entry, name, nil)
 
-		// Success!  Store the state we wrote to disk for later validation.
-		entry.logger.WithField("file", secret.Name).WithField("dir", entry.WriteDirectory).Info("Wrote file")
+		// Success!  Store the state we wrote for later validation.
+		entry.logger.WithField("file", secret.Name).Info("Wrote secret")
+		entry.stateMutex.Lock()
 		entry.SyncState[secret.Name] = secretState{sha256.Sum256(secret.Content), secret.Checksum, *fileinfo}
+		entry.stateMutex.Unlock()
+		progress.setWritten(int64(len(secret.Content)))
+	})
+
+	if onAllFailed != nil && tracker.allFailed() {
+		onAllFailed()
 	}
+
+	// All workers have drained: it's now safe to reconcile deletions against the final SyncState.
 	// For all secrets we've previously synced, remove state for ones not returned
 	for name, _ := range entry.SyncState {
 		if _, present := secrets[name]; !present {
@@ -240,58 +391,19 @@ func (entry *syncerEntry) Sync() error {
 	for _, name := range pendingDeletions {
 		entry.logger.WithField("secret", name).Info("Removing old secret")
 		delete(entry.SyncState, name)
-		os.Remove(filepath.Join(entry.WriteDirectory, name))
+		if err := entry.Sink.Delete(name); err != nil {
+			entry.logger.WithError(err).WithField("secret", name).Error("Failed removing old secret")
+		}
 	}
 
-	fileInfos, err := ioutil.ReadDir(entry.WriteDirectory)
-	if err != nil {
-		return fmt.Errorf("Couldn't read directory: %s\n", entry.WriteDirectory)
-	}
-	for _, fileInfo := range fileInfos {
-		existingFile := fileInfo.Name()
-		if _, present := entry.SyncState[existingFile]; !present {
-			// This file wasn't written in the loop above, so we remove it.
-			entry.logger.WithField("file", existingFile).Info("Removing unknown file")
-			os.Remove(filepath.Join(entry.WriteDirectory, existingFile))
+	if orphaned, ok := entry.Sink.(orphanRemover); ok {
+		keep := make(map[string]struct{}, len(entry.SyncState))
+		for name := range entry.SyncState {
+			keep[name] = struct{}{}
+		}
+		if err := orphaned.removeOrphans(keep); err != nil {
+			return err
 		}
 	}
 	return nil
 }
-
-// IsValidOnDisk verifies the secret is written to disk with the correct content, permissions, and ownership
-func (s *syncerEntry) IsValidOnDisk(secret Secret) bool {
-	state := s.SyncState[secret.Name]
-	if state.Checksum != secret.Checksum {
-		return false
-	}
-	path := filepath.Join(s.WriteDirectory, secret.Name)
-	// Check on-disk permissions, and ownership against what's configured.
-	f, err := os.Open(path)
-	if err != nil {
-		return false
-	}
-	fileinfo, err := GetFileInfo(f)
-	if err != nil {
-		return false
-	}
-	if state.FileInfo != *fileinfo {
-		return false
-	}
-
-	// Check the content of what's on disk
-	var b bytes.Buffer
-	_, err = b.ReadFrom(f)
-	if err != nil {
-		return false
-	}
-	hash := sha256.Sum256(b.Bytes())
-
-	if state.ContentHash != hash {
-		// As tempting as it is, we shouldn't log hashes as they'd leak information about the secret.
-		s.logger.WithField("secret", secret.Name).Warnf("Secret modified on disk?")
-		return false
-	}
-
-	// OK, the file is unchanged
-	return true
-}
@@ -0,0 +1,114 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build templatesink
+
+package keysync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func init() {
+	sinkBuilders["template"] = newTemplateSink
+}
+
+// TemplateSink renders a Go text/template referencing secret names into a single output file,
+// re-rendering it from scratch every time any of the secrets it references changes. It's modeled
+// on Vault agent templates: instead of keysync producing one file per secret, a client can
+// collect many secrets into one config file (e.g. application.yaml).
+type TemplateSink struct {
+	mu       sync.Mutex
+	tmpl     *template.Template
+	dest     string
+	contents map[string][]byte
+	logger   *logrus.Entry
+}
+
+func newTemplateSink(clientConfig ClientConfig, config *Config, logger *logrus.Entry) (SecretSink, error) {
+	tmplBytes, err := ioutil.ReadFile(clientConfig.TemplateSource)
+	if err != nil {
+		return nil, fmt.Errorf("reading template '%s': %v", clientConfig.TemplateSource, err)
+	}
+	tmpl, err := template.New(clientConfig.DirName).Parse(string(tmplBytes))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template '%s': %v", clientConfig.TemplateSource, err)
+	}
+	return &TemplateSink{
+		tmpl:     tmpl,
+		dest:     clientConfig.TemplateDest,
+		contents: map[string][]byte{},
+		logger:   logger,
+	}, nil
+}
+
+// Write implements SecretSink by recording secret's content and re-rendering the whole template.
+func (t *TemplateSink) Write(secret Secret) (*FileInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.contents[secret.Name] = secret.Content
+	if err := t.render(); err != nil {
+		return nil, err
+	}
+	return &FileInfo{}, nil
+}
+
+// Delete implements SecretSink by dropping name from the template data and re-rendering.
+func (t *TemplateSink) Delete(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.contents, name)
+	return t.render()
+}
+
+// Validate implements SecretSink by comparing against what we last recorded for name; the
+// rendered file as a whole doesn't carry enough information to validate any one secret.
+func (t *TemplateSink) Validate(secret Secret, state secretState) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	content, ok := t.contents[secret.Name]
+	if !ok {
+		return false
+	}
+	return state.Checksum == secret.Checksum && state.ContentHash == sha256.Sum256(content)
+}
+
+// render re-executes the template against the current secret set and atomically replaces dest.
+// Callers must hold t.mu.
+func (t *TemplateSink) render() error {
+	data := make(map[string]string, len(t.contents))
+	for name, content := range t.contents {
+		data[name] = string(content)
+	}
+	var out bytes.Buffer
+	if err := t.tmpl.Execute(&out, data); err != nil {
+		return fmt.Errorf("rendering template for '%s': %v", t.dest, err)
+	}
+	tmpFile := t.dest + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, out.Bytes(), 0600); err != nil {
+		return fmt.Errorf("writing rendered template '%s': %v", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, t.dest); err != nil {
+		return fmt.Errorf("renaming rendered template into place: %v", err)
+	}
+	return nil
+}